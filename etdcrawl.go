@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/beevik/etree"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -18,7 +19,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 /* Our metadata store in JSON */
@@ -29,30 +32,39 @@ type DocumentInfo struct {
 	DateTime   string `json:"dateTime"`
 	Abstract   string `json:"abstract"`
 	Document   string `json:"document"`
+	Sha256     string `json:"sha256,omitempty"`
+	Size       int64  `json:"size,omitempty"`
 }
 
-const (
-	baseIndexUrl        = "https://etd.unsyiah.ac.id/index.php"
-	baseIndexUrlDetails = "://etd.unsyiah.ac.id/index.php?p=show_detail&"
-	baseRepositoryUrl   = "https://etd.unsyiah.ac.id/repository/"
-)
+var activeProfile = defaultProfile
 
 var (
-	outDir      = "./"
-	embargoFlag = 0
-	pageIndex   = 1
-	maxPage     = 0xffffffff
-	minId       = 0
-	maxId       = 0xffffffff
-	withPdf     = true
-	ignoreCert  = false
+	outDir        = "./"
+	embargoFlag   = 0
+	pageIndex     = 1
+	maxPage       = 0xffffffff
+	minId         = 0
+	maxId         = 0xffffffff
+	withPdf       = true
+	ignoreCert    = false
+	workers       = 8
+	rps           = 0.0
+	storageKind   = "fs"
+	archiveFormat = "tar"
+	s3Endpoint    = ""
+	s3Bucket      = ""
+	s3AccessKey   = ""
+	s3SecretKey   = ""
 )
 
+var rateLimiter *RateLimiter
+var storage Storage
+
 var (
 	crawlCount    = 0
 	crawlCountMtx sync.Mutex
 	crawlDone     = false
-	crawlFetched  = make(map[string]bool) /* To avoid duplicate crawl */
+	crawlState    *CrawlState
 	crawlWg       sync.WaitGroup
 )
 
@@ -64,6 +76,7 @@ func isFileExists(filePath string) bool {
 }
 
 func fetchData(urlPath string) ([]byte, error) {
+	rateLimiter.Wait()
 	log.Printf("Fetching from %s", urlPath)
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: ignoreCert},
@@ -81,26 +94,45 @@ func fetchData(urlPath string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	atomic.AddInt64(&bytesDownloaded, int64(len(data)))
 	return data, nil
 }
 
+/* fetchStream is like fetchData but hands back the raw response body instead of buffering it, so large PDFs can be streamed straight into a Storage sink */
+func fetchStream(urlPath string) (io.ReadCloser, error) {
+	rateLimiter.Wait()
+	log.Printf("Fetching from %s", urlPath)
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: ignoreCert},
+	}
+	client := &http.Client{Transport: tr}
+	resp, err := client.Get(urlPath)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, errors.New("HTTP error " + strconv.Itoa(resp.StatusCode))
+	}
+	return resp.Body, nil
+}
+
 func getDocumentIdFromUrl(urlPath string) (string, bool) {
-	if strings.Contains(urlPath, baseIndexUrlDetails) {
+	if strings.Contains(urlPath, activeProfile.BaseIndexUrlDetails) {
 		urlParse, err := url.Parse(urlPath)
 		if err != nil {
 			return "", false
 		}
 		id := urlParse.Query().Get("id")
-		if _, exists := crawlFetched[id]; exists {
+		/* Don't repeat yourself */
+		if storage.Exists(id) {
+			crawlState.MarkProcessed(id)
+			return "", false
+		}
+		if !crawlState.ClaimForCrawl(id) {
 			return "", false
-		} else {
-			crawlFetched[id] = true
-			/* Don't repeat yourself */
-			if isFileExists(outDir + id + ".json") {
-				return "", false
-			}
-			return id, true
 		}
+		return id, true
 	} else {
 		return "", false
 	}
@@ -114,9 +146,9 @@ func parseIndexPage(pageData []byte) ([]string, error) {
 	}
 	var urls []string = nil
 	/* Iterate all entries in index, but limit only that *exists* in indexes! */
-	doc.Find("table.zebra-table").Each(func(i int, sel *goquery.Selection) {
+	doc.Find(activeProfile.IndexRowSelector).Each(func(i int, sel *goquery.Selection) {
 		/* Avoid abstract link, specific only to article details */
-		sel.Find("td a").Each(func(j int, sel *goquery.Selection) {
+		sel.Find(activeProfile.IndexLinkSelector).Each(func(j int, sel *goquery.Selection) {
 			if href, exists := sel.Attr("href"); exists {
 				/* eg: http://etd.unsyiah.ac.id/index.php?p=show_detail&id=14278 */
 				if id, exists := getDocumentIdFromUrl(href); exists {
@@ -128,78 +160,81 @@ func parseIndexPage(pageData []byte) ([]string, error) {
 	return urls, nil
 }
 
+/* crawlDocument enqueues docId onto the bounded worker pool started by startWorkers */
 func crawlDocument(docId string) {
-	go func(docId string) {
-		crawlWg.Add(1)
-		defer crawlWg.Done()
-		/* Fetch Slims metadata */
-		metadataUrl := "https://etd.unsyiah.ac.id/index.php?p=show_detail&inXML=true&id=" + docId
-		data, err := fetchData(metadataUrl)
+	crawlWg.Add(1)
+	jobChan <- docId
+}
+
+/* doCrawlDocument does the actual fetch-and-save work for docId; it runs on a worker pool goroutine dispatched by crawlDocument */
+func doCrawlDocument(docId string) {
+	/* Fetch Slims metadata */
+	metadataUrl := activeProfile.BaseIndexUrl + "?p=show_detail&inXML=true&id=" + docId
+	data, err := fetchData(metadataUrl)
+	if err != nil {
+		log.Printf("ERROR: Cannot fetch metadata for docId %s: %s", docId, err)
+		crawlState.PushRetry(docId)
+		return
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		log.Printf("ERROR: Cannot parse metadata for docId %s: %s", docId, err)
+		crawlState.PushRetry(docId)
+		return
+	}
+	/* Retrieve xml metadata and store at json struct, field locations coming from the active SiteProfile rather than being hardcoded to one portal's MODS layout */
+	var rootXml *etree.Element
+	if modsCollection := doc.SelectElement("modsCollection"); modsCollection != nil {
+		rootXml = modsCollection.SelectElement("mods")
+	}
+	if rootXml == nil {
+		log.Printf("ERROR: No <modsCollection><mods> found for docId %s, response may be an error page", docId)
+		crawlState.PushRetry(docId)
+		return
+	}
+	title := resolveElementText(rootXml, activeProfile.TitleElement)
+	author := resolveElementText(rootXml, activeProfile.AuthorElement)
+	abstract := resolveElementText(rootXml, activeProfile.AbstractElement)
+	dateTime := resolveElementText(rootXml, activeProfile.DateElement)
+	documentName := strings.ReplaceAll(resolveElementAttr(rootXml, activeProfile.DigitalItemElement, "path"), "/", "")
+	metadata := DocumentInfo{
+		DocumentId: docId,
+		Title:      title,
+		Author:     author,
+		DateTime:   dateTime,
+		Abstract:   abstract,
+		Document:   documentName,
+	}
+	/* Fetch real document, if available, deduping identical content by SHA-256 */
+	if withPdf && (documentName != "") {
+		sum, size, err := fetchAndStoreDocument(documentName, activeProfile.BaseRepositoryUrl+documentName)
 		if err != nil {
-			log.Printf("ERROR: Cannot fetch metadata for docId %s: %s", docId, err)
-			return
-		}
-		doc := etree.NewDocument()
-		if err := doc.ReadFromBytes(data); err != nil {
-			log.Printf("ERROR: Cannot parse metadata for docId %s: %s", docId, err)
+			log.Printf("ERROR: Cannot fetch PDF for docId %s: %s", docId, err)
+			crawlState.PushRetry(docId)
 			return
 		}
-		/* Retrieve xml metadata and store at json struct */
-		rootXml := doc.SelectElement("modsCollection").SelectElement("mods")
-		title := ""
-		if titleInfo := rootXml.SelectElement("titleInfo"); titleInfo != nil {
-			title = titleInfo.SelectElement("title").Text()
-		}
-		author := ""
-		if name := rootXml.SelectElement("name"); name != nil {
-			author = name.SelectElement("namePart").Text()
-		}
-		abstract := ""
-		if note := rootXml.SelectElement("note"); note != nil {
-			abstract = note.Text()
-		}
-		dateTime := ""
-		if recordInfo := rootXml.SelectElement("recordInfo"); recordInfo != nil {
-			dateTime = recordInfo.SelectElement("recordCreationDate").Text()
-		}
-		documentName := ""
-		if slimsDigital := rootXml.SelectElement("slims_digitals"); slimsDigital != nil {
-			documentName = strings.ReplaceAll(slimsDigital.SelectElement("slims_digital_item").SelectAttr("path").Value, "/", "")
-		}
-		metadata := DocumentInfo{
-			DocumentId: docId,
-			Title:      title,
-			Author:     author,
-			DateTime:   dateTime,
-			Abstract:   abstract,
-			Document:   documentName,
-		}
-		/* Fetch real document, if available */
-		if withPdf && (documentName != "") {
-			pdf, err := fetchData(baseRepositoryUrl + documentName)
-			if err != nil {
-				log.Printf("ERROR: Cannot fetch PDF for docId %s: %s", docId, err)
-				return
-			}
-			if err := ioutil.WriteFile(outDir+documentName, pdf, os.ModePerm); err != nil {
-				log.Printf("ERROR: Cannot write %s: %s", documentName, err)
-				return
-			}
-		}
-		/* If succeeded, save also metadata */
-		if jsonData, err := json.Marshal(metadata); err == nil {
-			if err = ioutil.WriteFile(outDir+docId+".json", jsonData, os.ModePerm); err == nil {
-				log.Printf("Document %s saved!", docId)
-				crawlCountMtx.Lock()
-				crawlCount++
-				crawlCountMtx.Unlock()
-			} else {
-				log.Printf("ERROR: Cannot save metadata for %s, %s", docId, err)
+		metadata.Sha256 = sum
+		metadata.Size = size
+	}
+	/* If succeeded, save also metadata */
+	if jsonData, err := json.Marshal(metadata); err == nil {
+		if err = storage.PutMetadata(docId, jsonData); err == nil {
+			if err := manifestIndex.Append(metadata); err != nil {
+				log.Printf("WARNING: Cannot append manifest entry for %s: %s", docId, err)
 			}
+			log.Printf("Document %s saved!", docId)
+			crawlCountMtx.Lock()
+			crawlCount++
+			crawlCountMtx.Unlock()
+			crawlState.MarkProcessed(docId)
 		} else {
-			log.Printf("ERROR: Cannot marshall metadata for %s, %s", docId, err)
+			log.Printf("ERROR: Cannot save metadata for %s, %s", docId, err)
+			crawlState.PushRetry(docId)
 		}
-	}(docId)
+	} else {
+		log.Printf("ERROR: Cannot marshall metadata for %s, %s", docId, err)
+		crawlState.PushRetry(docId)
+	}
 }
 
 func main() {
@@ -215,14 +250,35 @@ func main() {
 	maxIdPtr := flag.Int("max", maxId, "Maximum content id")
 	withPdfPtr := flag.Bool("pdf", withPdf, "Fetch with full PDF document")
 	ignoreCertPtr := flag.Bool("ignorecert", ignoreCert, "Ignore TLS certificate errors")
+	workersPtr := flag.Int("workers", workers, "Number of concurrent fetch workers")
+	rpsPtr := flag.Float64("rps", rps, "Maximum requests per second (0 for unlimited)")
+	silentPtr := flag.Bool("silent", silent, "Suppress progress bar output")
+	storageKindPtr := flag.String("storage", storageKind, "Storage backend: fs, archive, or s3")
+	archiveFormatPtr := flag.String("archivefmt", archiveFormat, "Archive format for -storage=archive: tar or zip")
+	s3EndpointPtr := flag.String("s3endpoint", s3Endpoint, "S3-compatible endpoint URL for -storage=s3")
+	s3BucketPtr := flag.String("s3bucket", s3Bucket, "Bucket name for -storage=s3")
+	s3AccessKeyPtr := flag.String("s3accesskey", os.Getenv("AWS_ACCESS_KEY_ID"), "Access key for -storage=s3 (defaults to AWS_ACCESS_KEY_ID)")
+	s3SecretKeyPtr := flag.String("s3secretkey", os.Getenv("AWS_SECRET_ACCESS_KEY"), "Secret key for -storage=s3 (defaults to AWS_SECRET_ACCESS_KEY)")
+	profilePtr := flag.String("profile", "", "Site profile: builtin name (unsyiah, unimal, unsam) or path to a YAML/JSON profile file")
+	discoverPtr := flag.String("discover", "", "Probe the given base URL for SLiMS/MODS support and exit, instead of crawling")
+	oaiPtr := flag.String("oai", "", "OAI-PMH endpoint to harvest from instead of scraping HTML index pages")
+	verifyPtr := flag.Bool("verify", false, "Rewalk outDir and report files whose hash no longer matches manifest.jsonl, then exit")
 	/* Don't forget to parse */
 	flag.Parse()
+	if *discoverPtr != "" {
+		discoverSite(*discoverPtr)
+		return
+	}
 	/* Assign to global variables */
 	outDir = *outDirPtr
 	if outDir == "" {
 		log.Print("Error: output directory not specified!")
 		return
 	}
+	if *verifyPtr {
+		verifyManifest(outDir)
+		return
+	}
 	embargoFlag = *embargoFlagPtr
 	pageIndex = *pageIndexPtr
 	maxPage = *maxPagePtr
@@ -230,26 +286,81 @@ func main() {
 	maxId = *maxIdPtr
 	withPdf = *withPdfPtr
 	ignoreCert = *ignoreCertPtr
+	workers = *workersPtr
+	rps = *rpsPtr
+	silent = *silentPtr
+	storageKind = *storageKindPtr
+	archiveFormat = *archiveFormatPtr
+	s3Endpoint = *s3EndpointPtr
+	s3Bucket = *s3BucketPtr
+	s3AccessKey = *s3AccessKeyPtr
+	s3SecretKey = *s3SecretKeyPtr
+	profile, err := loadProfile(*profilePtr)
+	if err != nil {
+		log.Fatalf("Error: cannot load site profile: %s", err)
+	}
+	activeProfile = profile
+	storage, err = newStorage(storageKind, outDir)
+	if err != nil {
+		log.Fatalf("Error: cannot initialize %s storage: %s", storageKind, err)
+	}
+	defer storage.Close()
+	manifestIndex, err = openManifest(outDir)
+	if err != nil {
+		log.Fatalf("Error: cannot open manifest: %s", err)
+	}
+	defer manifestIndex.Close()
+	/* Resume from a previous checkpoint if one exists */
+	crawlState = loadCrawlState(outDir)
+	pageIndex = crawlState.PageIndex
+	rateLimiter = newRateLimiter(rps)
+	startWorkers(workers)
 	/* CTRL+C Interrupt handler */
 	c := make(chan os.Signal)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		log.Print("Caught in interrupt!")
+		log.Print("Caught in interrupt! Flushing crawl state...")
 		crawlDone = true
+		if err := crawlState.Save(); err != nil {
+			log.Printf("WARNING: Cannot save crawl state: %s", err)
+		}
 	}()
+	/* Progress bar reporting to stderr until crawling is done */
+	progressDone := make(chan struct{})
+	crawlStartTime = time.Now()
+	go startProgressReporter(progressDone)
+	defer close(progressDone)
 	/* Do crawling */
 	crawlDone = false
-	urlIndexBase, err := url.Parse(baseIndexUrl)
+	if *oaiPtr != "" {
+		harvestOai(*oaiPtr)
+		if err := crawlState.Save(); err != nil {
+			log.Printf("WARNING: Cannot save crawl state: %s", err)
+		}
+		log.Printf("Done, %d documents was fetched", crawlCount)
+		return
+	}
+	urlIndexBase, err := url.Parse(activeProfile.BaseIndexUrl)
 	if err != nil {
 		log.Fatal(err)
 	}
 	q := urlIndexBase.Query()
 	q.Add("embargo", strconv.Itoa(embargoFlag))
+	/* sawAnyUrls tracks whether any index page has yielded documents yet, so an empty page
+	   is only treated as "end of index" once we're actually past the last one, without
+	   depending on how many document jobs the worker pool has finished so far */
+	sawAnyUrls := false
 	for idx := pageIndex; idx <= maxPage; idx++ {
 		if crawlDone {
 			break
 		}
+		pageIndex = idx
+		crawlState.SetPageIndex(idx)
+		/* Give documents that failed on a previous pass another chance once their backoff elapses */
+		for _, docId := range crawlState.DueRetries() {
+			crawlDocument(docId)
+		}
 		q.Set("page", strconv.Itoa(idx))
 		urlIndexBase.RawQuery = q.Encode()
 		urlIndex := urlIndexBase.String()
@@ -262,20 +373,31 @@ func main() {
 				log.Printf("WARNING: Parse %s error: %s", urlIndex, err)
 			} else {
 				/* Have fetched before but indexes are empty now */
-				if (urls == nil) && (crawlCount > 0) {
+				if (urls == nil) && sawAnyUrls {
 					log.Print("No more document in index page")
 					break
 				} else {
-					/* Iterate and fetch pending documents */
+					if urls != nil {
+						sawAnyUrls = true
+					}
+					/* Enqueue pending documents onto the worker pool; crawlDocument only
+					   blocks once the job channel is full, so the next page's index fetch
+					   keeps pipelining with document fetches still in flight */
 					for i := 0; i < len(urls); i++ {
 						crawlDocument(urls[i])
 					}
 				}
 			}
 		}
-		/* We hate corrupt result, be patient until all done */
-		log.Print("Waiting for pending routines...")
-		crawlWg.Wait()
+		atomic.AddInt64(&pagesCompleted, 1)
+		if err := crawlState.Save(); err != nil {
+			log.Printf("WARNING: Cannot save crawl state: %s", err)
+		}
+	}
+	log.Print("Waiting for pending routines...")
+	crawlWg.Wait()
+	if err := crawlState.Save(); err != nil {
+		log.Printf("WARNING: Cannot save crawl state: %s", err)
 	}
 	log.Printf("Done, %d documents was fetched", crawlCount)
 }
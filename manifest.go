@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const manifestFileName = "manifest.jsonl"
+
+var manifestIndex *DedupIndex
+
+/* DedupIndex maps a document's SHA-256 digest to the path it was most recently recorded under, and appends one line per saved document to outDir/manifest.jsonl as an integrity record. */
+type DedupIndex struct {
+	mtx   sync.Mutex
+	paths map[string]string /* sha256 -> document path relative to outDir */
+	file  *os.File
+	enc   *json.Encoder
+}
+
+/* openManifest rehydrates the dedup index from any manifest.jsonl left by a previous run, so reruns recognize already-saved documents without re-hashing them, then reopens the file for appending new entries. */
+func openManifest(outDir string) (*DedupIndex, error) {
+	idx := &DedupIndex{paths: make(map[string]string)}
+	path := filepath.Join(outDir, manifestFileName)
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry DocumentInfo
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil && entry.Sha256 != "" {
+				idx.paths[entry.Sha256] = entry.Document
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		log.Printf("WARNING: Cannot read manifest %s: %s", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	idx.file = f
+	idx.enc = json.NewEncoder(f)
+	return idx, nil
+}
+
+/* PathFor returns the path a document with this digest was already saved under, if any */
+func (idx *DedupIndex) PathFor(sha256sum string) (string, bool) {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	p, ok := idx.paths[sha256sum]
+	return p, ok
+}
+
+/* Append records a newly-saved document, both in the in-memory dedup index and as a new line in manifest.jsonl */
+func (idx *DedupIndex) Append(entry DocumentInfo) error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	if entry.Sha256 != "" {
+		idx.paths[entry.Sha256] = entry.Document
+	}
+	return idx.enc.Encode(entry)
+}
+
+func (idx *DedupIndex) Close() error {
+	if idx.file == nil {
+		return nil
+	}
+	return idx.file.Close()
+}
+
+/* fetchAndStoreDocument streams fetchUrl through a SHA-256 hasher into a temp file, then either hard-links documentName to an identical document already in the store or, if this is new content, moves the temp data into storage under documentName. Spooling through disk rather than a []byte keeps memory use low while still letting us compute the digest before deciding whether a write is even necessary. */
+func fetchAndStoreDocument(documentName string, fetchUrl string) (sha256sum string, size int64, err error) {
+	body, err := fetchStream(fetchUrl)
+	if err != nil {
+		return "", 0, err
+	}
+	defer body.Close()
+	tmp, err := ioutil.TempFile("", "etdcrawl-doc-*.tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hasher := sha256.New()
+	size, err = io.Copy(tmp, io.TeeReader(&countingReader{r: body}, hasher))
+	if err != nil {
+		return "", 0, err
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	if existingPath, ok := manifestIndex.PathFor(sum); ok {
+		if err := storage.LinkDocument(existingPath, documentName); err == nil {
+			return sum, size, nil
+		}
+		/* Backend can't link (e.g. archive output); fall through to a normal write */
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	if err := storage.PutDocument(documentName, tmp); err != nil {
+		return "", 0, err
+	}
+	return sum, size, nil
+}
+
+/* verifyManifest rewalks outDir, recomputing each manifest.jsonl entry's SHA-256 and reporting any file that's missing or whose digest no longer matches */
+func verifyManifest(outDir string) {
+	path := filepath.Join(outDir, manifestFileName)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Error: cannot open manifest %s: %s", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	checked := 0
+	mismatches := 0
+	for scanner.Scan() {
+		var entry DocumentInfo
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Document == "" || entry.Sha256 == "" {
+			continue
+		}
+		checked++
+		docFile, err := os.Open(filepath.Join(outDir, entry.Document))
+		if err != nil {
+			fmt.Printf("MISSING: %s (%s): %s\n", entry.DocumentId, entry.Document, err)
+			mismatches++
+			continue
+		}
+		hasher := sha256.New()
+		_, err = io.Copy(hasher, docFile)
+		docFile.Close()
+		if err != nil {
+			fmt.Printf("ERROR: %s (%s): %s\n", entry.DocumentId, entry.Document, err)
+			mismatches++
+			continue
+		}
+		if sum := hex.EncodeToString(hasher.Sum(nil)); sum != entry.Sha256 {
+			fmt.Printf("MISMATCH: %s (%s): manifest=%s actual=%s\n", entry.DocumentId, entry.Document, entry.Sha256, sum)
+			mismatches++
+		}
+	}
+	fmt.Printf("Verified %d documents, %d mismatches\n", checked, mismatches)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	bytesDownloaded int64
+	pagesCompleted  int64
+	crawlStartTime  time.Time
+	silent          = false
+)
+
+/* countingReader wraps an io.Reader, tallying bytes read into bytesDownloaded so the progress bar stays accurate even when a body is streamed straight into storage */
+type countingReader struct {
+	r io.Reader
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&bytesDownloaded, int64(n))
+	}
+	return n, err
+}
+
+/* isTerminal reports whether f is connected to an interactive terminal */
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return (stat.Mode() & os.ModeCharDevice) != 0
+}
+
+/* startProgressReporter ticks once a second printing fetch progress to stderr until done is closed. It's suppressed by -silent or when stderr isn't a TTY, so piping output to a file or log collector doesn't fill it with carriage-return spam. */
+func startProgressReporter(done <-chan struct{}) {
+	if silent || !isTerminal(os.Stderr) {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			printProgress()
+		}
+	}
+}
+
+func printProgress() {
+	crawlCountMtx.Lock()
+	count := crawlCount
+	crawlCountMtx.Unlock()
+	elapsed := time.Since(crawlStartTime).Seconds()
+	eta := "unknown"
+	if done := atomic.LoadInt64(&pagesCompleted); done > 0 && maxPage != 0xffffffff {
+		avgPerPage := elapsed / float64(done)
+		remaining := int64(maxPage - pageIndex)
+		if remaining < 0 {
+			remaining = 0
+		}
+		eta = time.Duration(avgPerPage * float64(remaining) * float64(time.Second)).Round(time.Second).String()
+	}
+	fmt.Fprintf(os.Stderr, "\r[page %d] %d documents, %s downloaded, ETA %s    ",
+		pageIndex, count, formatBytes(atomic.LoadInt64(&bytesDownloaded)), eta)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for n2 := n / unit; n2 >= unit; n2 /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const stateFileName = ".etdcrawl-state.json"
+
+/* RetryEntry tracks a failed fetch that should be attempted again once its backoff elapses */
+type RetryEntry struct {
+	DocumentId  string    `json:"documentId"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+/* CrawlState is the resumable checkpoint persisted to outDir/.etdcrawl-state.json, letting a multi-thousand document crawl be interrupted and resumed without re-walking index pages. */
+type CrawlState struct {
+	Processed  map[string]bool `json:"processed"`
+	PageIndex  int             `json:"pageIndex"`
+	RetryQueue []RetryEntry    `json:"retryQueue"`
+	mtx        sync.Mutex
+	path       string
+	/* pending tracks the attempt count of retries currently popped off RetryQueue and
+	   in flight, so a failure can carry the count forward instead of resetting to 1.
+	   Deliberately not persisted: a retry in flight when the process dies just restarts
+	   its backoff, which is an acceptable rare edge case. */
+	pending map[string]int
+	/* queued marks docIds that have already been handed to crawlDocument this run but
+	   haven't reached MarkProcessed yet. Deliberately separate from Processed: a page's
+	   row can link the same docId twice (e.g. a title link and a cover-image link to the
+	   same show_detail&id=N), and Processed only flips once the fetch actually succeeds.
+	   Not persisted: it only needs to survive for the lifetime of one run. */
+	queued map[string]bool
+}
+
+func newCrawlState(outDir string) *CrawlState {
+	return &CrawlState{
+		Processed: make(map[string]bool),
+		PageIndex: pageIndex,
+		path:      filepath.Join(outDir, stateFileName),
+		pending:   make(map[string]int),
+		queued:    make(map[string]bool),
+	}
+}
+
+/* loadCrawlState rehydrates a CrawlState from disk, falling back to a fresh one if it's missing or corrupt */
+func loadCrawlState(outDir string) *CrawlState {
+	cs := newCrawlState(outDir)
+	data, err := ioutil.ReadFile(cs.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("WARNING: Cannot read state file %s: %s", cs.path, err)
+		}
+		return cs
+	}
+	if err := json.Unmarshal(data, cs); err != nil {
+		log.Printf("WARNING: Cannot parse state file %s, starting fresh: %s", cs.path, err)
+		return newCrawlState(outDir)
+	}
+	if cs.Processed == nil {
+		cs.Processed = make(map[string]bool)
+	}
+	log.Printf("Resuming crawl from state file, page %d, %d documents already processed", cs.PageIndex, len(cs.Processed))
+	return cs
+}
+
+/* IsProcessed reports whether docId has already been fetched successfully in a previous run */
+func (cs *CrawlState) IsProcessed(docId string) bool {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	return cs.Processed[docId]
+}
+
+func (cs *CrawlState) MarkProcessed(docId string) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.Processed[docId] = true
+	cs.removeFromRetryQueueLocked(docId)
+	delete(cs.pending, docId)
+	delete(cs.queued, docId)
+}
+
+/* ClaimForCrawl reports whether docId should be handed to crawlDocument, atomically marking it queued if so. It's false for anything already processed or already queued earlier this run (it does not consult the storage backend itself; getDocumentIdFromUrl marks docIds the backend already holds as processed before calling it), so an index row linking the same docId twice (e.g. a title link and a cover-image link) only enqueues one job. */
+func (cs *CrawlState) ClaimForCrawl(docId string) bool {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if cs.Processed[docId] || cs.queued[docId] {
+		return false
+	}
+	cs.queued[docId] = true
+	return true
+}
+
+func (cs *CrawlState) SetPageIndex(idx int) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.PageIndex = idx
+}
+
+/* PushRetry enqueues docId for a later attempt, backing off exponentially with each failed attempt. If docId was popped off the queue by DueRetries and is now failing again, its prior attempt count is carried forward from pending rather than resetting to 1. */
+func (cs *CrawlState) PushRetry(docId string) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	for i := range cs.RetryQueue {
+		if cs.RetryQueue[i].DocumentId == docId {
+			cs.RetryQueue[i].Attempts++
+			cs.RetryQueue[i].NextAttempt = time.Now().Add(backoffDuration(cs.RetryQueue[i].Attempts))
+			return
+		}
+	}
+	attempts := cs.pending[docId] + 1
+	delete(cs.pending, docId)
+	cs.RetryQueue = append(cs.RetryQueue, RetryEntry{
+		DocumentId:  docId,
+		Attempts:    attempts,
+		NextAttempt: time.Now().Add(backoffDuration(attempts)),
+	})
+}
+
+func (cs *CrawlState) removeFromRetryQueueLocked(docId string) {
+	for i, entry := range cs.RetryQueue {
+		if entry.DocumentId == docId {
+			cs.RetryQueue = append(cs.RetryQueue[:i], cs.RetryQueue[i+1:]...)
+			return
+		}
+	}
+}
+
+/* DueRetries pops and returns the queued retries whose backoff has already elapsed, stashing each one's attempt count in pending so a subsequent PushRetry for the same docId keeps counting up instead of restarting at 1 */
+func (cs *CrawlState) DueRetries() []string {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	var due []string
+	var remaining []RetryEntry
+	now := time.Now()
+	for _, entry := range cs.RetryQueue {
+		if now.After(entry.NextAttempt) {
+			due = append(due, entry.DocumentId)
+			cs.pending[entry.DocumentId] = entry.Attempts
+		} else {
+			remaining = append(remaining, entry)
+		}
+	}
+	cs.RetryQueue = remaining
+	return due
+}
+
+/* backoffDuration grows exponentially with attempt count, capped so a flaky document doesn't stall the retry queue forever */
+func backoffDuration(attempts int) time.Duration {
+	d := time.Duration(1<<uint(attempts-1)) * time.Second
+	if d > 5*time.Minute {
+		d = 5 * time.Minute
+	}
+	return d
+}
+
+/* Save atomically persists the state by writing to a temp file and renaming it into place, so a crash or SIGINT mid-write can never leave a truncated state file behind */
+func (cs *CrawlState) Save() error {
+	cs.mtx.Lock()
+	data, err := json.Marshal(cs)
+	cs.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := cs.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, cs.path)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+/* errLinkUnsupported is returned by LinkDocument when a backend has no cheap way to make two names refer to the same content; callers should fall back to a normal PutDocument */
+var errLinkUnsupported = errors.New("storage backend does not support linking documents")
+
+/* Storage abstracts where crawled metadata and documents end up, so crawlDocument can target a plain directory, a single portable archive, or an S3-compatible bucket without knowing which one it's writing to. */
+type Storage interface {
+	/* Exists reports whether metadata for docId was already saved to this backend; the archive
+	   backend starts empty each run, so it only knows about entries written in the current run */
+	Exists(docId string) bool
+	PutMetadata(docId string, data []byte) error
+	PutDocument(name string, r io.Reader) error
+	/* LinkDocument makes newName refer to the same bytes as an already-saved existingName,
+	   a hard link where supported, so content-addressed dedup can skip a redundant write.
+	   Returns errLinkUnsupported if the backend has no such facility. */
+	LinkDocument(existingName, newName string) error
+	Close() error
+}
+
+/* newStorage builds the configured backend; archive and s3 both funnel through here so main only needs to know the -storage flag value */
+func newStorage(kind string, outDir string) (Storage, error) {
+	switch kind {
+	case "", "fs":
+		return newFileStorage(outDir), nil
+	case "archive":
+		return newArchiveStorage(outDir, archiveFormat)
+	case "s3":
+		return newS3Storage(s3Endpoint, s3Bucket, s3AccessKey, s3SecretKey)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", kind)
+	}
+}
+
+/* ---- Filesystem backend: the crawler's original on-disk layout ---- */
+
+type FileStorage struct {
+	outDir string
+}
+
+func newFileStorage(outDir string) *FileStorage {
+	return &FileStorage{outDir: outDir}
+}
+
+func (s *FileStorage) Exists(docId string) bool {
+	return isFileExists(s.outDir + docId + ".json")
+}
+
+func (s *FileStorage) PutMetadata(docId string, data []byte) error {
+	return ioutil.WriteFile(s.outDir+docId+".json", data, os.ModePerm)
+}
+
+func (s *FileStorage) PutDocument(name string, r io.Reader) error {
+	path := s.outDir + name
+	/* name may include subdirectories, e.g. IIIF page images under outDir/<docId>/ */
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+/* LinkDocument hard-links newName to existingName, falling back to a symlink if the hard link fails for any reason (e.g. the two paths aren't on the same filesystem) */
+func (s *FileStorage) LinkDocument(existingName, newName string) error {
+	oldPath := s.outDir + existingName
+	newPath := s.outDir + newName
+	if dir := filepath.Dir(newPath); dir != "." {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	if err := os.Link(oldPath, newPath); err == nil {
+		return nil
+	}
+	return os.Symlink(oldPath, newPath)
+}
+
+func (s *FileStorage) Close() error {
+	return nil
+}
+
+/* ---- Archive backend: streams every entry into a single outDir/corpus.tar.gz
+   or outDir/corpus.zip, so a whole crawl can be carried around as one file ---- */
+
+type ArchiveStorage struct {
+	mtx     sync.Mutex
+	format  string
+	file    *os.File
+	gzw     *gzip.Writer
+	tw      *tar.Writer
+	zw      *zip.Writer
+	written map[string]bool
+}
+
+/* newArchiveStorage always starts its corpus file empty: archive/tar and archive/zip are append-only streams with no way to look up or skip an entry already written by a previous run, so there's no honest way to resume into one. If a corpus from an earlier run is still there, it's about to be truncated; warn loudly and drop that run's checkpoint too, since resuming crawlState.Processed against a corpus we just emptied would skip documents and silently produce an incomplete archive. */
+func newArchiveStorage(outDir string, format string) (*ArchiveStorage, error) {
+	name := "corpus.tar.gz"
+	if format == "zip" {
+		name = "corpus.zip"
+	}
+	path := filepath.Join(outDir, name)
+	if isFileExists(path) {
+		log.Printf("WARNING: -storage=archive cannot resume an existing corpus, %s will be truncated and the crawl restarted from scratch", path)
+		statePath := filepath.Join(outDir, stateFileName)
+		if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("WARNING: Cannot discard previous crawl state %s: %s", statePath, err)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	as := &ArchiveStorage{format: format, file: f, written: make(map[string]bool)}
+	if format == "zip" {
+		as.zw = zip.NewWriter(f)
+	} else {
+		as.gzw = gzip.NewWriter(f)
+		as.tw = tar.NewWriter(as.gzw)
+	}
+	return as, nil
+}
+
+func (s *ArchiveStorage) Exists(docId string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.written[docId]
+}
+
+func (s *ArchiveStorage) PutMetadata(docId string, data []byte) error {
+	if err := s.putEntry(docId+".json", bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	s.written[docId] = true
+	s.mtx.Unlock()
+	return nil
+}
+
+func (s *ArchiveStorage) PutDocument(name string, r io.Reader) error {
+	if s.format == "zip" {
+		return s.putEntry(name, r, -1)
+	}
+	/* archive/tar needs the entry size up front, so spool the body through a temp
+	   file first instead of buffering the whole PDF in memory */
+	tmp, err := ioutil.TempFile("", "etdcrawl-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.putEntry(name, tmp, size)
+}
+
+func (s *ArchiveStorage) putEntry(name string, r io.Reader, size int64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.format == "zip" {
+		w, err := s.zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		return err
+	}
+	if err := s.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size}); err != nil {
+		return err
+	}
+	_, err := io.Copy(s.tw, r)
+	return err
+}
+
+/* LinkDocument is unsupported: tar and zip have no notion of hard links, so the caller falls back to writing the bytes again */
+func (s *ArchiveStorage) LinkDocument(existingName, newName string) error {
+	return errLinkUnsupported
+}
+
+func (s *ArchiveStorage) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.format == "zip" {
+		if err := s.zw.Close(); err != nil {
+			return err
+		}
+		return s.file.Close()
+	}
+	if err := s.tw.Close(); err != nil {
+		return err
+	}
+	if err := s.gzw.Close(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+/* ---- S3-compatible backend ---- */
+
+type S3Storage struct {
+	bucket   string
+	uploader *s3manager.Uploader
+	client   *s3.S3
+}
+
+func newS3Storage(endpoint, bucket, accessKey, secretKey string) (*S3Storage, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("-s3bucket is required for the s3 storage backend")
+	}
+	cfg := aws.Config{
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+	if accessKey != "" && secretKey != "" {
+		cfg.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
+	}
+	sess, err := session.NewSession(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Storage{
+		bucket:   bucket,
+		uploader: s3manager.NewUploader(sess),
+		client:   s3.New(sess),
+	}, nil
+}
+
+func (s *S3Storage) Exists(docId string) bool {
+	_, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(docId + ".json"),
+	})
+	return err == nil
+}
+
+func (s *S3Storage) PutMetadata(docId string, data []byte) error {
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(docId + ".json"),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (s *S3Storage) PutDocument(name string, r io.Reader) error {
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+		Body:   r,
+	})
+	return err
+}
+
+/* LinkDocument uses a server-side CopyObject instead of re-uploading the bytes, which is S3's equivalent of a cheap hard link */
+func (s *S3Storage) LinkDocument(existingName, newName string) error {
+	_, err := s.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		CopySource: aws.String(s.bucket + "/" + existingName),
+		Key:        aws.String(newName),
+	})
+	return err
+}
+
+func (s *S3Storage) Close() error {
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/* jobChan feeds docIds to the bounded worker pool started by startWorkers */
+var jobChan chan string
+
+/* startWorkers launches n persistent goroutines draining jobChan, replacing the previous pattern of spawning an unbounded goroutine per document */
+func startWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	jobChan = make(chan string, n*4)
+	for i := 0; i < n; i++ {
+		go func() {
+			for docId := range jobChan {
+				runCrawlJob(docId)
+			}
+		}()
+	}
+}
+
+/* runCrawlJob isolates a single job so a panic in doCrawlDocument (e.g. an unexpected XML shape) can't take down a pool goroutine or leave crawlWg.Wait() blocked forever */
+func runCrawlJob(docId string) {
+	defer crawlWg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: Recovered from panic crawling docId %s: %v", docId, r)
+			crawlState.PushRetry(docId)
+		}
+	}()
+	doCrawlDocument(docId)
+}
+
+/* RateLimiter is a simple token-bucket limiter shared by fetchData and fetchStream to keep the request rate under -rps requests per second */
+type RateLimiter struct {
+	mtx        sync.Mutex
+	rate       float64
+	bucket     float64
+	capacity   float64
+	lastRefill time.Time
+}
+
+/* newRateLimiter returns nil (meaning unlimited) when rps is not positive */
+func newRateLimiter(rps float64) *RateLimiter {
+	if rps <= 0 {
+		return nil
+	}
+	/* The bucket must hold at least one whole token, or a fractional -rps could never grant one */
+	capacity := rps
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &RateLimiter{
+		rate:       rps,
+		bucket:     capacity,
+		capacity:   capacity,
+		lastRefill: time.Now(),
+	}
+}
+
+/* Wait blocks, if necessary, until a token is available. A nil receiver is a no-op, so callers don't need to special-case "no limiter configured". */
+func (rl *RateLimiter) Wait() {
+	if rl == nil {
+		return
+	}
+	for {
+		rl.mtx.Lock()
+		now := time.Now()
+		rl.bucket += now.Sub(rl.lastRefill).Seconds() * rl.rate
+		if rl.bucket > rl.capacity {
+			rl.bucket = rl.capacity
+		}
+		rl.lastRefill = now
+		if rl.bucket >= 1 {
+			rl.bucket--
+			rl.mtx.Unlock()
+			return
+		}
+		wait := time.Duration((1 - rl.bucket) / rl.rate * float64(time.Second))
+		rl.mtx.Unlock()
+		time.Sleep(wait)
+	}
+}